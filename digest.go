@@ -0,0 +1,127 @@
+package veneur
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// sketchCompression bounds how many centroids a Histo's t-digest keeps.
+// 100 keeps a serialized digest well under a kilobyte while holding P99
+// error under 1%, which is plenty for the percentiles veneur reports.
+const sketchCompression = 100
+
+// Centroid is a single compressed point in a TDigest: a mean and the
+// total weight (sample count) that rounded to it.
+type Centroid struct {
+	Mean   float64 `json:"mean"`
+	Weight float64 `json:"weight"`
+}
+
+// TDigest is a small, mergeable quantile sketch. Instead of keeping every
+// sample, it keeps a bounded set of weighted centroids, so its serialized
+// form stays tiny even for a huge histogram and two digests computed on
+// different hosts can be merged before anyone asks for a quantile. That's
+// what makes cross-host P99s statistically meaningful: merging raw
+// per-host percentiles is not.
+type TDigest struct {
+	Compression int
+
+	centroids []Centroid
+	count     float64
+}
+
+// NewTDigest returns an empty digest that keeps at most compression
+// centroids once compacted.
+func NewTDigest(compression int) *TDigest {
+	return &TDigest{Compression: compression}
+}
+
+// Add records a single sample with the given weight. Weight is usually
+// 1/sampleRate, to correct for client-side sampling.
+func (t *TDigest) Add(value, weight float64) {
+	t.centroids = append(t.centroids, Centroid{Mean: value, Weight: weight})
+	t.count += weight
+	if len(t.centroids) > t.Compression*4 {
+		t.compress()
+	}
+}
+
+// Merge folds other's centroids into t, combining per-host digests into a
+// single fleet-wide view.
+func (t *TDigest) Merge(other *TDigest) {
+	if other == nil {
+		return
+	}
+	t.centroids = append(t.centroids, other.centroids...)
+	t.count += other.count
+	t.compress()
+}
+
+// Quantile returns an estimate of the qth quantile, where 0 <= q <= 1.
+func (t *TDigest) Quantile(q float64) float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	t.compress()
+	target := q * t.count
+	var cumulative float64
+	for _, c := range t.centroids {
+		cumulative += c.Weight
+		if cumulative >= target {
+			return c.Mean
+		}
+	}
+	return t.centroids[len(t.centroids)-1].Mean
+}
+
+// Count returns the total weight (sample count) the digest represents.
+func (t *TDigest) Count() float64 {
+	return t.count
+}
+
+// compress sorts the centroids by mean and, if there are more than
+// Compression of them, merges adjacent groups down to that many.
+func (t *TDigest) compress() {
+	sort.Slice(t.centroids, func(i, j int) bool { return t.centroids[i].Mean < t.centroids[j].Mean })
+	if t.Compression <= 0 || len(t.centroids) <= t.Compression {
+		return
+	}
+
+	merged := make([]Centroid, 0, t.Compression)
+	groupSize := (len(t.centroids) + t.Compression - 1) / t.Compression
+	for i := 0; i < len(t.centroids); i += groupSize {
+		end := i + groupSize
+		if end > len(t.centroids) {
+			end = len(t.centroids)
+		}
+		var weight, weightedSum float64
+		for _, c := range t.centroids[i:end] {
+			weight += c.Weight
+			weightedSum += c.Mean * c.Weight
+		}
+		merged = append(merged, Centroid{Mean: weightedSum / weight, Weight: weight})
+	}
+	t.centroids = merged
+}
+
+type wireDigest struct {
+	Compression int        `json:"compression"`
+	Centroids   []Centroid `json:"centroids"`
+	Count       float64    `json:"count"`
+}
+
+// Marshal serializes the digest so it can be forwarded to a global
+// veneur instance for merging.
+func (t *TDigest) Marshal() ([]byte, error) {
+	t.compress()
+	return json.Marshal(wireDigest{t.Compression, t.centroids, t.count})
+}
+
+// UnmarshalTDigest reconstructs a digest previously produced by Marshal.
+func UnmarshalTDigest(data []byte) (*TDigest, error) {
+	var wire wireDigest
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return nil, err
+	}
+	return &TDigest{Compression: wire.Compression, centroids: wire.Centroids, count: wire.Count}, nil
+}
@@ -1,20 +1,11 @@
 package veneur
 
 import (
-	"bytes"
-	"compress/zlib"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"sync"
 	"time"
-
-	"github.com/Sirupsen/logrus"
 )
 
-// Flush takes the slices of metrics, combines then and marshals them to json
-// for posting to Datadog.
+// Flush takes the slices of metrics, combines them, and fans the result out
+// to every sink in s.sinks in parallel.
 func (s *Server) Flush(interval time.Duration, metricLimit int) {
 	postMetrics := make([][]DDMetric, len(s.Workers))
 	totalCount := 0
@@ -40,6 +31,41 @@ func (s *Server) Flush(interval time.Duration, metricLimit int) {
 		return
 	}
 
+	flushStart := time.Now()
+	s.flushSinks(finalMetrics, metricLimit)
+	s.statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Now().Sub(flushStart).Nanoseconds()), nil, 1.0)
+
+	s.statsd.Count("flush.error_total", 0, nil, 0.1) // make sure this metric is not sparse
+	s.logger.WithField("metrics", totalCount).Info("Completed flush")
+}
+
+// defaultFlushConcurrency bounds concurrent sink deliveries when the
+// server hasn't been given an explicit scheduler.
+const defaultFlushConcurrency = 8
+
+// defaultPerDestinationRate caps deliveries/sec to any one destination
+// when the server hasn't been given an explicit scheduler. 0 would mean
+// unlimited; we'd rather a new deployment notice a conservative default
+// than accidentally hammer a downstream API.
+const defaultPerDestinationRate = 20
+
+// flushSinks breaks finalMetrics into chunks of approximately metricLimit
+// size and schedules every chunk/sink pair onto s.scheduler, which bounds
+// how many deliveries are in flight at once (and per destination),
+// regardless of how many chunks this interval produced. Every op of one
+// call carries the same created time, so no chunk of the interval takes
+// priority over another.
+func (s *Server) flushSinks(finalMetrics []DDMetric, metricLimit int) {
+	if len(s.sinks) == 0 {
+		s.logger.Warn("No sinks configured, dropping flushed metrics")
+		return
+	}
+	if s.scheduler == nil {
+		s.scheduler = newFlushScheduler(defaultFlushConcurrency, defaultPerDestinationRate)
+	}
+
+	totalCount := len(finalMetrics)
+
 	// break the metrics into chunks of approximately equal size, such that
 	// each chunk is less than the limit
 	// we compute the chunks using rounding-up integer division
@@ -47,94 +73,27 @@ func (s *Server) Flush(interval time.Duration, metricLimit int) {
 	chunkSize := ((totalCount - 1) / workers) + 1
 	s.logger.WithField("workers", workers).Debug("Worker count chosen")
 	s.logger.WithField("chunkSize", chunkSize).Debug("Chunk size chosen")
-	var wg sync.WaitGroup
-	flushStart := time.Now()
+
+	now := time.Now()
+	ops := make([]*flushOp, 0, workers*len(s.sinks))
 	for i := 0; i < workers; i++ {
 		chunk := finalMetrics[i*chunkSize:]
 		if i < workers-1 {
 			// trim to chunk size unless this is the last one
 			chunk = chunk[:chunkSize]
 		}
-		wg.Add(1)
-		go s.flushPart(chunk, &wg)
-	}
-	wg.Wait()
-	s.statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Now().Sub(flushStart).Nanoseconds()), nil, 1.0)
-
-	s.statsd.Count("flush.error_total", 0, nil, 0.1) // make sure this metric is not sparse
-	s.logger.WithField("metrics", totalCount).Info("Completed flush to Datadog")
-}
-
-func (s *Server) flushPart(metricSlice []DDMetric, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	cstart := time.Now()
-	var reqBody bytes.Buffer
-	compressor := zlib.NewWriter(&reqBody)
-	encoder := json.NewEncoder(compressor)
-	err := encoder.Encode(map[string][]DDMetric{
-		"series": metricSlice,
-	})
-	if err != nil {
-		s.statsd.Count("flush.error_total", int64(len(metricSlice)), []string{"cause:json"}, 1.0)
-		s.logger.WithError(err).Error("Error rendering JSON request body")
-		return
-	}
-	// make sure to flush remaining compressed bytes to the buffer
-	compressor.Close()
-	s.statsd.TimeInMilliseconds(
-		"flush.part_duration_ns",
-		float64(time.Now().Sub(cstart).Nanoseconds()),
-		[]string{"part:marshal"},
-		1.0,
-	)
-	// Len reports the unread length, so we have to record this before it's POSTed
-	bodyLength := reqBody.Len()
-	s.statsd.Histogram("flush.content_length_bytes", float64(bodyLength), nil, 1.0)
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/series?api_key=%s", s.DDHostname, s.DDAPIKey), &reqBody)
-	if err != nil {
-		s.statsd.Count("flush.error_total", int64(len(metricSlice)), []string{"cause:construct"}, 1.0)
-		s.logger.WithError(err).Error("Error constructing POST request")
-		return
+		for _, sink := range s.sinks {
+			ops = append(ops, &flushOp{sink: sink, chunk: chunk, created: now})
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "deflate")
 
-	fstart := time.Now()
-	resp, err := http.DefaultClient.Do(req) // TODO: add configurable http client to server struct
-	if err != nil {
-		s.statsd.Count("flush.error_total", int64(len(metricSlice)), []string{"cause:io"}, 1.0)
-		s.logger.WithError(err).Error("Error writing POST request")
-		return
-	}
-	s.statsd.TimeInMilliseconds(
-		"flush.part_duration_ns",
-		float64(time.Now().Sub(fstart).Nanoseconds()),
-		[]string{"part:post"},
-		1.0,
+	s.scheduler.run(ops,
+		func(op *flushOp) error {
+			return op.sink.Flush(op.chunk)
+		},
+		func(op *flushOp, err error) {
+			s.statsd.Count("flush.error_total", int64(len(op.chunk)), []string{"sink:" + op.sink.Name()}, 1.0)
+			s.logger.WithError(err).WithField("sink", op.sink.Name()).Error("Error flushing to sink")
+		},
 	)
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		// don't bail out if this errors, we'll just log the body as empty
-		s.logger.WithError(err).Error("Error reading response body")
-	}
-	resultFields := logrus.Fields{
-		"status":           resp.Status,
-		"request_headers":  req.Header,
-		"response_headers": resp.Header,
-		"request_length":   bodyLength,
-		"response":         string(body),
-		"total_metrics":    len(metricSlice),
-	}
-
-	if resp.StatusCode != http.StatusAccepted {
-		s.statsd.Count("flush.error_total", int64(len(metricSlice)), []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
-		s.logger.WithFields(resultFields).Error("Error POSTing")
-		return
-	}
-
-	s.logger.WithFields(resultFields).Debug("POSTing JSON")
-}
\ No newline at end of file
+}
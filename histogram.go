@@ -0,0 +1,122 @@
+package veneur
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Histo samples a histogram or timer using a t-digest instead of keeping
+// every raw value. Percentiles can be estimated locally, but the digest
+// itself is also forwardable: Flush emits it as a "sketch" DDMetric so a
+// designated "global" veneur can merge digests from every host before
+// extracting a percentile, which is the only way a P99 across a fleet of
+// veneurs is actually correct.
+//
+// A host whose digests are forwarded to a global veneur (i.e. one with a
+// ForwardMetricSink configured) should NOT also report its own local
+// percentile/min/max/count: those are statistically wrong per-host
+// numbers that would collide, under the same metric name and suffix,
+// with the correct fleet-wide ones the global veneur reports from the
+// merged digest. localPercentiles controls that: set it false wherever
+// forwarding is configured.
+type Histo struct {
+	Name             string
+	Tags             []string
+	digest           *TDigest
+	percentiles      []float64
+	useCounter       bool
+	localPercentiles bool
+	min, max         float64
+	count            int64
+}
+
+// NewHist returns a Histo that always forwards its digest as a sketch
+// metric. When localPercentiles is true, Flush also reports percentile,
+// min, max (and, if useCounter, count) metrics computed locally; set it
+// to false on any host that forwards to a global veneur, so the two
+// don't report conflicting numbers under the same metric name.
+func NewHist(name string, tags []string, percentiles []float64, useCounter bool, localPercentiles bool) *Histo {
+	return &Histo{
+		Name:             name,
+		Tags:             tags,
+		digest:           NewTDigest(sketchCompression),
+		percentiles:      percentiles,
+		useCounter:       useCounter,
+		localPercentiles: localPercentiles,
+	}
+}
+
+// Sample records value, weighted by 1/sampleRate to correct for
+// client-side sampling.
+func (h *Histo) Sample(value float64, sampleRate float32) {
+	weight := float64(1)
+	if sampleRate > 0 {
+		weight = 1 / float64(sampleRate)
+	}
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if h.count == 0 || value > h.max {
+		h.max = value
+	}
+	h.digest.Add(value, weight)
+	h.count++
+}
+
+// Flush returns a "sketch" DDMetric carrying the serialized digest for a
+// forward sink to ship upstream, plus — only when h.localPercentiles is
+// set — the locally-estimated percentile/min/max/count metrics for this
+// histogram.
+func (h *Histo) Flush(interval time.Duration) []DDMetric {
+	metrics := make([]DDMetric, 0, len(h.percentiles)+4)
+	if h.localPercentiles {
+		for _, p := range h.percentiles {
+			metrics = append(metrics, DDMetric{
+				Name:       fmt.Sprintf("%s.%s", h.Name, percentileSuffix(p)),
+				Value:      gaugeValue(h.digest.Quantile(p)),
+				Tags:       h.Tags,
+				MetricType: "gauge",
+			})
+		}
+		metrics = append(metrics,
+			DDMetric{Name: h.Name + ".min", Value: gaugeValue(h.min), Tags: h.Tags, MetricType: "gauge"},
+			DDMetric{Name: h.Name + ".max", Value: gaugeValue(h.max), Tags: h.Tags, MetricType: "gauge"},
+		)
+		if h.useCounter {
+			// h.digest.Count() is the sample-rate-weighted total (each
+			// Sample call adds 1/sampleRate), unlike h.count, which is
+			// just the number of Sample calls. Using the weighted total
+			// here keeps the reported rate consistent with the
+			// percentiles/min/max, which are also computed from the
+			// weighted digest.
+			metrics = append(metrics, DDMetric{
+				Name:       h.Name + ".count",
+				Value:      gaugeValue(h.digest.Count() / interval.Seconds()),
+				Tags:       h.Tags,
+				MetricType: "rate",
+			})
+		}
+	}
+
+	digestBytes, err := h.digest.Marshal()
+	if err == nil {
+		metrics = append(metrics, DDMetric{
+			Name:       h.Name,
+			Tags:       h.Tags,
+			MetricType: "sketch",
+			SketchData: digestBytes,
+		})
+	}
+	return metrics
+}
+
+// percentileSuffix renders a quantile like 0.99 as the "99percentile"
+// suffix veneur has always used for Datadog metric names.
+func percentileSuffix(p float64) string {
+	return strconv.FormatFloat(p*100, 'f', -1, 64) + "percentile"
+}
+
+func gaugeValue(v float64) [1][2]float64 {
+	return [1][2]float64{{float64(time.Now().Unix()), v}}
+}
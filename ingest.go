@@ -0,0 +1,107 @@
+package veneur
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// GlobalHistoAggregator merges t-digest sketches forwarded from other
+// veneur instances (via ForwardMetricSink) into one digest per metric, so
+// a "global" veneur can compute percentiles across an entire fleet rather
+// than per-host. It is safe for concurrent use.
+type GlobalHistoAggregator struct {
+	mu      sync.Mutex
+	digests map[string]*mergedDigest
+	logger  *logrus.Logger
+}
+
+type mergedDigest struct {
+	name   string
+	tags   []string
+	digest *TDigest
+}
+
+// NewGlobalHistoAggregator returns an empty aggregator.
+func NewGlobalHistoAggregator(logger *logrus.Logger) *GlobalHistoAggregator {
+	return &GlobalHistoAggregator{
+		digests: make(map[string]*mergedDigest),
+		logger:  logger,
+	}
+}
+
+// Merge folds sketch into whichever per-metric digest it belongs to,
+// keyed by name and tags.
+func (g *GlobalHistoAggregator) Merge(sketch DDMetric) error {
+	if sketch.MetricType != "sketch" {
+		return fmt.Errorf("expected a sketch metric, got %q", sketch.MetricType)
+	}
+	incoming, err := UnmarshalTDigest(sketch.SketchData)
+	if err != nil {
+		return fmt.Errorf("unmarshaling digest for %s: %v", sketch.Name, err)
+	}
+
+	key := sketchKey(sketch.Name, sketch.Tags)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	existing, ok := g.digests[key]
+	if !ok {
+		g.digests[key] = &mergedDigest{name: sketch.Name, tags: sketch.Tags, digest: incoming}
+		return nil
+	}
+	existing.digest.Merge(incoming)
+	return nil
+}
+
+// Flush returns percentile DDMetrics computed from every merged digest
+// and resets the aggregator for the next interval.
+func (g *GlobalHistoAggregator) Flush(percentiles []float64) []DDMetric {
+	g.mu.Lock()
+	merged := g.digests
+	g.digests = make(map[string]*mergedDigest)
+	g.mu.Unlock()
+
+	metrics := make([]DDMetric, 0, len(merged)*len(percentiles))
+	for _, m := range merged {
+		for _, p := range percentiles {
+			metrics = append(metrics, DDMetric{
+				Name:       fmt.Sprintf("%s.%s", m.name, percentileSuffix(p)),
+				Value:      gaugeValue(m.digest.Quantile(p)),
+				Tags:       m.tags,
+				MetricType: "gauge",
+			})
+		}
+	}
+	return metrics
+}
+
+func sketchKey(name string, tags []string) string {
+	return name + "|" + strings.Join(tags, ",")
+}
+
+// SketchIngestHandler returns an http.Handler for "/import/sketches": the
+// endpoint a ForwardMetricSink POSTs serialized digests to on a global
+// veneur instance.
+func (g *GlobalHistoAggregator) SketchIngestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var sketches []DDMetric
+		if err := json.NewDecoder(r.Body).Decode(&sketches); err != nil {
+			http.Error(w, "malformed body", http.StatusBadRequest)
+			return
+		}
+		for _, sketch := range sketches {
+			if err := g.Merge(sketch); err != nil {
+				g.logger.WithError(err).WithField("name", sketch.Name).Error("Error merging forwarded sketch")
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
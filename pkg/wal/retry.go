@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// Sender delivers a single WAL entry. It is typically a thin adapter
+// around a MetricSink's Flush method for one destination.
+type Sender func(Entry) error
+
+// RetryManager redelivers WAL entries that failed on their first attempt,
+// backing off exponentially (with jitter) between tries and giving up once
+// an entry is older than MaxAge.
+type RetryManager struct {
+	wal    *WAL
+	send   Sender
+	statsd *statsd.Client
+
+	MaxAge    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingEntry
+	wake    chan struct{}
+	quit    chan struct{}
+}
+
+type pendingEntry struct {
+	id      string
+	entry   Entry
+	nextTry time.Time
+}
+
+// NewRetryManager returns a RetryManager that redelivers through send and
+// records queue depth against wal.
+func NewRetryManager(w *WAL, send Sender, stats *statsd.Client) *RetryManager {
+	return &RetryManager{
+		wal:       w,
+		send:      send,
+		statsd:    stats,
+		MaxAge:    24 * time.Hour,
+		BaseDelay: time.Second,
+		MaxDelay:  5 * time.Minute,
+		pending:   make(map[string]*pendingEntry),
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+}
+
+// LoadFromDisk replays the WAL and enqueues every entry it finds, so a
+// veneur that crashed mid-flush resumes retrying where it left off.
+func (r *RetryManager) LoadFromDisk() error {
+	entries, err := r.wal.Replay()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range entries {
+		r.pending[e.ID] = &pendingEntry{id: e.ID, entry: e.Entry, nextTry: time.Now()}
+	}
+	return nil
+}
+
+// Track schedules entry, which the caller has already appended to the WAL
+// under id, for redelivery. The caller is expected to call wal.Append
+// before attempting its first delivery (so the entry is durable before
+// it's ever sent) and Track only once that first attempt has failed.
+func (r *RetryManager) Track(id string, entry Entry) {
+	r.mu.Lock()
+	r.pending[id] = &pendingEntry{id: id, entry: entry, nextTry: time.Now().Add(r.backoff(entry.Attempt))}
+	queued := len(r.pending)
+	r.mu.Unlock()
+	r.statsd.Gauge("flush.retry.queued", float64(queued), []string{"sink:" + entry.Sink}, 1.0)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run drives redelivery until Stop is called. It's meant to be started in
+// its own goroutine.
+func (r *RetryManager) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-r.wake:
+			r.retryDue()
+		case <-ticker.C:
+			r.retryDue()
+			if bytes, err := r.wal.Bytes(); err == nil {
+				r.statsd.Gauge("flush.wal.bytes", float64(bytes), nil, 1.0)
+			}
+		}
+	}
+}
+
+// Stop halts the retry loop. In-flight redeliveries are allowed to finish.
+func (r *RetryManager) Stop() {
+	close(r.quit)
+}
+
+func (r *RetryManager) retryDue() {
+	now := time.Now()
+	var due []*pendingEntry
+	r.mu.Lock()
+	for _, p := range r.pending {
+		if now.Sub(p.entry.Created) > r.MaxAge {
+			delete(r.pending, p.id)
+			r.wal.Delete(p.id)
+			r.statsd.Count("flush.retry.dropped", 1, []string{"sink:" + p.entry.Sink, "cause:max_age"}, 1.0)
+			continue
+		}
+		if now.After(p.nextTry) {
+			due = append(due, p)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, p := range due {
+		p.entry.Attempt++
+		err := r.send(p.entry)
+		if err == nil {
+			r.wal.Delete(p.id)
+			r.mu.Lock()
+			delete(r.pending, p.id)
+			queued := len(r.pending)
+			r.mu.Unlock()
+			r.statsd.Gauge("flush.retry.queued", float64(queued), []string{"sink:" + p.entry.Sink}, 1.0)
+			continue
+		}
+		r.mu.Lock()
+		p.nextTry = time.Now().Add(r.backoff(p.entry.Attempt))
+		r.mu.Unlock()
+	}
+}
+
+// backoff computes an exponentially increasing delay for the given attempt
+// count, capped at MaxDelay and jittered down to between 50% and 100% of
+// that delay to avoid a thundering herd of retries all landing on the
+// same tick.
+func (r *RetryManager) backoff(attempt int) time.Duration {
+	delay := r.BaseDelay << uint(attempt)
+	if delay <= 0 || delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)))
+	return delay/2 + jitter/2
+}
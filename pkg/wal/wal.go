@@ -0,0 +1,148 @@
+// Package wal implements a small segmented write-ahead log used to back the
+// flush retry queue: a pending flush chunk is appended to disk before it is
+// POSTed anywhere, so a veneur that crashes mid-flush doesn't silently drop
+// an interval. Each segment holds exactly one entry; that's wasteful of
+// inodes but makes deleting an acknowledged entry a single os.Remove rather
+// than a compaction pass.
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a single pending delivery: a pre-serialized (and, for HTTP
+// sinks, pre-compressed) body bound for a destination, plus how many times
+// delivery has already been attempted.
+type Entry struct {
+	Sink        string    `json:"sink"`
+	Destination string    `json:"destination"`
+	Body        []byte    `json:"body"`
+	Attempt     int       `json:"attempt"`
+	Created     time.Time `json:"created"`
+}
+
+// WAL is a directory of segment files, one per pending Entry. It is safe
+// for concurrent use.
+type WAL struct {
+	dir      string
+	mu       sync.Mutex
+	nextSeq  uint64
+	maxBytes int64
+}
+
+// New returns a WAL rooted at dir, creating it if necessary. maxDiskBytes
+// bounds the total size of unacknowledged segments; Append returns an
+// error once that budget is exhausted rather than growing the log
+// unbounded.
+func New(dir string, maxDiskBytes int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating WAL directory: %v", err)
+	}
+	return &WAL{dir: dir, maxBytes: maxDiskBytes}, nil
+}
+
+// Append writes entry to a new segment and returns the segment's ID, which
+// Delete later uses to remove it.
+func (w *WAL) Append(entry Entry) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if used, err := w.diskBytesLocked(); err == nil && used >= w.maxBytes && w.maxBytes > 0 {
+		return "", fmt.Errorf("WAL disk budget (%d bytes) exhausted", w.maxBytes)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("marshaling WAL entry: %v", err)
+	}
+
+	w.nextSeq++
+	id := fmt.Sprintf("%020d-%d", time.Now().UnixNano(), w.nextSeq)
+	path := w.segmentPath(id)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return "", fmt.Errorf("writing WAL segment: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("committing WAL segment: %v", err)
+	}
+	return id, nil
+}
+
+// Delete removes the segment for id. It is a no-op if the segment is
+// already gone, since redelivery and startup replay can race.
+func (w *WAL) Delete(id string) error {
+	err := os.Remove(w.segmentPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Replay returns every currently-pending entry, oldest first, so the
+// caller can hand them back to a RetryManager on startup.
+func (w *WAL) Replay() ([]struct {
+	ID    string
+	Entry Entry
+}, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading WAL directory: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var out []struct {
+		ID    string
+		Entry Entry
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(w.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			continue
+		}
+		out = append(out, struct {
+			ID    string
+			Entry Entry
+		}{ID: strings.TrimSuffix(f.Name(), ".seg"), Entry: e})
+	}
+	return out, nil
+}
+
+// Bytes returns the total size, in bytes, of every pending segment. It
+// backs the flush.wal.bytes gauge.
+func (w *WAL) Bytes() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.diskBytesLocked()
+}
+
+func (w *WAL) diskBytesLocked() (int64, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	return total, nil
+}
+
+func (w *WAL) segmentPath(id string) string {
+	return filepath.Join(w.dir, id+".seg")
+}
@@ -0,0 +1,165 @@
+package veneur
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// flushOp is a unit of scheduled flush work: one chunk of metrics bound
+// for one sink. created is when the chunk was minted, which flushOpQueue
+// uses to give older chunks priority over fresh ones; flushSinks stamps
+// every op of one interval with the same time. attempt counts how many
+// times this op has already been tried.
+type flushOp struct {
+	sink    MetricSink
+	chunk   []DDMetric
+	created time.Time
+	attempt int
+}
+
+// flushOpQueue is a container/heap.Interface ordered so the oldest
+// (highest-priority) op pops first.
+type flushOpQueue []*flushOp
+
+func (q flushOpQueue) Len() int            { return len(q) }
+func (q flushOpQueue) Less(i, j int) bool  { return q[i].created.Before(q[j].created) }
+func (q flushOpQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *flushOpQueue) Push(x interface{}) { *q = append(*q, x.(*flushOp)) }
+func (q *flushOpQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	op := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return op
+}
+
+// rateLimiter is a token bucket used to cap how many deliveries per
+// second a single destination receives, independent of how many worker
+// slots flushScheduler has free.
+type rateLimiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newRateLimiter(ratePerSecond float64) *rateLimiter {
+	return &rateLimiter{
+		tokens:   ratePerSecond,
+		capacity: ratePerSecond,
+		rate:     ratePerSecond,
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until a token is available, refilling at r.rate tokens/sec.
+func (r *rateLimiter) wait() {
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		r.last = now
+		if r.tokens > r.capacity {
+			r.tokens = r.capacity
+		}
+		if r.tokens >= 1 {
+			r.tokens--
+			r.mu.Unlock()
+			return
+		}
+		sleep := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+		r.mu.Unlock()
+		time.Sleep(sleep)
+	}
+}
+
+// flushScheduler runs a bounded pool of workers that pull flushOps off a
+// priority queue (oldest chunk first) and deliver them, optionally rate
+// limiting each destination independently. This caps how many concurrent
+// deliveries a single flush interval can open, pops older chunks ahead of
+// fresher ones when both are queued in the same run, and keeps a single
+// destination from being hammered even when plenty of worker slots are
+// free. Redeliveries made by RetryingSink go through wal.RetryManager and
+// never pass through this queue.
+type flushScheduler struct {
+	concurrency int
+	perDestRate float64 // tokens/sec per destination; 0 disables rate limiting
+
+	mu       sync.Mutex
+	queue    flushOpQueue
+	limiters map[string]*rateLimiter
+}
+
+// newFlushScheduler returns a scheduler that runs at most concurrency
+// deliveries at a time, additionally capping each destination (identified
+// by MetricSink.Name) to perDestRate deliveries/sec. A perDestRate of 0
+// disables the per-destination limit.
+func newFlushScheduler(concurrency int, perDestRate float64) *flushScheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &flushScheduler{
+		concurrency: concurrency,
+		perDestRate: perDestRate,
+		limiters:    make(map[string]*rateLimiter),
+	}
+}
+
+func (s *flushScheduler) limiterFor(destination string) *rateLimiter {
+	if s.perDestRate <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[destination]
+	if !ok {
+		l = newRateLimiter(s.perDestRate)
+		s.limiters[destination] = l
+	}
+	return l
+}
+
+// run delivers every op in ops using at most s.concurrency workers at
+// once, oldest op first, calling deliver for each and onError for any
+// that return an error. It blocks until the queue is drained.
+func (s *flushScheduler) run(ops []*flushOp, deliver func(*flushOp) error, onError func(*flushOp, error)) {
+	s.mu.Lock()
+	s.queue = make(flushOpQueue, 0, len(ops))
+	for _, op := range ops {
+		heap.Push(&s.queue, op)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				op := s.next()
+				if op == nil {
+					return
+				}
+				if limiter := s.limiterFor(op.sink.Name()); limiter != nil {
+					limiter.wait()
+				}
+				if err := deliver(op); err != nil && onError != nil {
+					onError(op, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *flushScheduler) next() *flushOp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&s.queue).(*flushOp)
+}
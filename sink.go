@@ -0,0 +1,18 @@
+package veneur
+
+// MetricSink is implemented by anything that Server.Flush can hand a batch
+// of metrics to. Each sink owns the conversion to its backend's wire format
+// and the delivery itself; Server only knows how to fan metrics out to
+// whichever sinks are configured and tally the results.
+type MetricSink interface {
+	// Name identifies the sink for logging and for tagging per-sink
+	// flush metrics (e.g. "flush.error_total" tagged "sink:<Name>").
+	Name() string
+
+	// Flush delivers metrics to the sink's backend. A non-nil error
+	// indicates at least part of metrics did not make it out (a sink
+	// that splits a batch over several requests may already have
+	// delivered a leading part); the caller counts the whole slice as
+	// failed.
+	Flush(metrics []DDMetric) error
+}
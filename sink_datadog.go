@@ -0,0 +1,205 @@
+package veneur
+
+import (
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultMaxCompressedBytes bounds how much zlib-compressed JSON a single
+// Datadog POST carries. It's measured post-compression rather than by
+// metric count, so peak memory for a flush stays flat no matter how big
+// (or how repetitive, and thus compressible) an interval's metrics are.
+const defaultMaxCompressedBytes = 3 * 1024 * 1024
+
+// DatadogMetricSink delivers metrics to the Datadog HTTP series endpoint.
+// It is the original (and default) veneur sink.
+type DatadogMetricSink struct {
+	HTTPClient *http.Client
+	APIKey     string
+	DDHostname string
+
+	// MaxCompressedBytes is the auto-splitter's threshold. Zero means
+	// defaultMaxCompressedBytes.
+	MaxCompressedBytes int
+
+	statsd *statsd.Client
+	logger *logrus.Logger
+}
+
+// NewDatadogMetricSink returns a sink that POSTs to the given Datadog
+// hostname using the given API key.
+func NewDatadogMetricSink(ddHostname, apiKey string, stats *statsd.Client, logger *logrus.Logger) *DatadogMetricSink {
+	return &DatadogMetricSink{
+		HTTPClient: http.DefaultClient,
+		APIKey:     apiKey,
+		DDHostname: ddHostname,
+		statsd:     stats,
+		logger:     logger,
+	}
+}
+
+// Name returns "datadog".
+func (dd *DatadogMetricSink) Name() string {
+	return "datadog"
+}
+
+func (dd *DatadogMetricSink) maxCompressedBytes() int {
+	if dd.MaxCompressedBytes > 0 {
+		return dd.MaxCompressedBytes
+	}
+	return defaultMaxCompressedBytes
+}
+
+// Flush streams metricSlice to Datadog's series endpoint as zlib-compressed
+// JSON, chunked over one or more requests. A request is split, rather
+// than buffering the whole body, the moment its compressed size crosses
+// maxCompressedBytes, so peak memory is bounded by that threshold instead
+// of by how many metrics this flush produced.
+func (dd *DatadogMetricSink) Flush(metricSlice []DDMetric) error {
+	start := time.Now()
+	for len(metricSlice) > 0 {
+		sent, err := dd.flushStream(metricSlice)
+		if err != nil {
+			return err
+		}
+		metricSlice = metricSlice[sent:]
+	}
+	dd.statsd.TimeInMilliseconds(
+		"flush.part_duration_ns",
+		float64(time.Now().Sub(start).Nanoseconds()),
+		[]string{"sink:" + dd.Name()},
+		1.0,
+	)
+	return nil
+}
+
+// flushStream POSTs a prefix of metrics in a single chunked request,
+// ending with the metric whose compressed output reaches
+// maxCompressedBytes (or with the last metric), and returns how many of
+// them it consumed so Flush can loop over the remainder.
+func (dd *DatadogMetricSink) flushStream(metrics []DDMetric) (int, error) {
+	pr, pw := io.Pipe()
+	sentCh := make(chan int, 1)
+	go func() {
+		sent, err := dd.encodeSeries(pw, metrics, dd.maxCompressedBytes())
+		sentCh <- sent
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/series?api_key=%s", dd.DDHostname, dd.APIKey), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-sentCh
+		return 0, fmt.Errorf("constructing POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "deflate")
+	req.TransferEncoding = []string{"chunked"}
+
+	resp, err := dd.HTTPClient.Do(req)
+	sent := <-sentCh
+	if err != nil {
+		return 0, fmt.Errorf("writing POST request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		// don't bail out if this errors, we'll just log the body as empty
+		dd.logger.WithError(readErr).Error("Error reading response body")
+	}
+	resultFields := logrus.Fields{
+		"status":           resp.Status,
+		"response":         string(body),
+		"metrics_in_chunk": sent,
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		dd.logger.WithFields(resultFields).Error("Error POSTing")
+		return 0, fmt.Errorf("datadog returned %s", resp.Status)
+	}
+
+	dd.logger.WithFields(resultFields).Debug("POSTing JSON")
+	return sent, nil
+}
+
+// encodeSeries writes metrics as Datadog's {"series": [...]} JSON body,
+// zlib-compressed, to w, stopping after the metric whose compressed
+// output reaches maxBytes, so a body can run past maxBytes by that last
+// metric. It returns how many of metrics it consumed, skipped sketches
+// included.
+func (dd *DatadogMetricSink) encodeSeries(w io.WriteCloser, metrics []DDMetric, maxBytes int) (sent int, err error) {
+	defer w.Close()
+
+	counter := &countingWriter{w: w}
+	compressor := zlib.NewWriter(counter)
+	defer compressor.Close()
+
+	if _, err = io.WriteString(compressor, `{"series":[`); err != nil {
+		return sent, err
+	}
+	written := 0
+	for _, m := range metrics {
+		sent++
+
+		// Sketches only make sense to a forward sink/global veneur; they
+		// have no Datadog series representation (and no real Value), so
+		// POSTing one verbatim would put a bogus zero-valued point on
+		// Datadog's side.
+		if m.MetricType == "sketch" {
+			if counter.n >= maxBytes && sent < len(metrics) {
+				break
+			}
+			continue
+		}
+
+		if written > 0 {
+			if _, err = io.WriteString(compressor, ","); err != nil {
+				return sent, err
+			}
+		}
+		data, encErr := json.Marshal(m)
+		if encErr != nil {
+			return sent, encErr
+		}
+		if _, err = compressor.Write(data); err != nil {
+			return sent, err
+		}
+		written++
+
+		// Flush lets counter see the bytes this metric actually cost,
+		// so the size check below is based on real compressed output
+		// rather than zlib's internal buffering.
+		if err = compressor.Flush(); err != nil {
+			return sent, err
+		}
+		if counter.n >= maxBytes && sent < len(metrics) {
+			break
+		}
+	}
+	if _, err = io.WriteString(compressor, `]}`); err != nil {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// countingWriter tallies how many bytes have passed through it, so
+// encodeSeries can track compressed output size without buffering it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
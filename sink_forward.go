@@ -0,0 +1,82 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+)
+
+// ForwardMetricSink ships "sketch" DDMetrics to a designated "global"
+// veneur instance, which merges the per-host t-digests before computing
+// percentiles. Non-sketch metrics are dropped: those are still flushed
+// locally by whatever sinks this instance also has configured.
+type ForwardMetricSink struct {
+	HTTPClient  *http.Client
+	ForwardAddr string
+	statsd      *statsd.Client
+	logger      *logrus.Logger
+}
+
+// NewForwardMetricSink returns a sink that POSTs sketches to the global
+// veneur listening at forwardAddr.
+func NewForwardMetricSink(forwardAddr string, stats *statsd.Client, logger *logrus.Logger) *ForwardMetricSink {
+	return &ForwardMetricSink{
+		HTTPClient:  http.DefaultClient,
+		ForwardAddr: forwardAddr,
+		statsd:      stats,
+		logger:      logger,
+	}
+}
+
+// Name returns "forward".
+func (f *ForwardMetricSink) Name() string {
+	return "forward"
+}
+
+// Flush POSTs every sketch metric in metricSlice to the global veneur's
+// ingest endpoint as JSON.
+func (f *ForwardMetricSink) Flush(metricSlice []DDMetric) error {
+	sketches := make([]DDMetric, 0, len(metricSlice))
+	for _, m := range metricSlice {
+		if m.MetricType == "sketch" {
+			sketches = append(sketches, m)
+		}
+	}
+	if len(sketches) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(sketches); err != nil {
+		return fmt.Errorf("marshaling sketches: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/import/sketches", f.ForwardAddr), &body)
+	if err != nil {
+		return fmt.Errorf("constructing POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := f.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("writing POST request: %v", err)
+	}
+	defer resp.Body.Close()
+	f.statsd.TimeInMilliseconds(
+		"flush.part_duration_ns",
+		float64(time.Now().Sub(start).Nanoseconds()),
+		[]string{"sink:" + f.Name()},
+		1.0,
+	)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("global veneur returned %s", resp.Status)
+	}
+	return nil
+}
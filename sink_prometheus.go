@@ -0,0 +1,149 @@
+package veneur
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// PrometheusMetricSink converts metrics into Prometheus's remote_write
+// protobuf format and POSTs them, snappy-compressed, to a remote_write
+// endpoint such as Cortex or a Prometheus instance with remote-write
+// receiving enabled.
+type PrometheusMetricSink struct {
+	HTTPClient *http.Client
+	WriteURL   string
+	statsd     *statsd.Client
+	logger     *logrus.Logger
+}
+
+// NewPrometheusMetricSink returns a sink that writes to the given
+// remote_write URL.
+func NewPrometheusMetricSink(writeURL string, stats *statsd.Client, logger *logrus.Logger) *PrometheusMetricSink {
+	return &PrometheusMetricSink{
+		HTTPClient: http.DefaultClient,
+		WriteURL:   writeURL,
+		statsd:     stats,
+		logger:     logger,
+	}
+}
+
+// Name returns "prometheus".
+func (p *PrometheusMetricSink) Name() string {
+	return "prometheus"
+}
+
+// Flush converts metricSlice into a prompb.WriteRequest and POSTs it,
+// snappy-compressed, to the configured remote_write URL.
+func (p *PrometheusMetricSink) Flush(metricSlice []DDMetric) error {
+	start := time.Now()
+	req := &prompb.WriteRequest{
+		Timeseries: make([]*prompb.TimeSeries, 0, len(metricSlice)),
+	}
+	for _, metric := range metricSlice {
+		if metric.MetricType == "sketch" {
+			// t-digest sketches have no native remote_write representation;
+			// they're only meaningful to a forward sink/global veneur.
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, ddMetricToTimeSeries(metric))
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshaling WriteRequest: %v", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequest(http.MethodPost, p.WriteURL, bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("constructing POST request: %v", err)
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := p.HTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("writing POST request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	p.statsd.TimeInMilliseconds(
+		"flush.part_duration_ns",
+		float64(time.Now().Sub(start).Nanoseconds()),
+		[]string{"sink:" + p.Name()},
+		1.0,
+	)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("prometheus remote_write returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ddMetricToTimeSeries converts a single DDMetric into a prompb.TimeSeries,
+// splitting veneur's "k:v" tags into Prometheus label pairs. Tags without a
+// colon are kept as boolean-style labels with an empty value. Labels are
+// deduped by name (first occurrence wins) and sorted lexicographically,
+// since remote_write receivers like Prometheus and Cortex reject a
+// TimeSeries whose labels aren't in that order.
+func ddMetricToTimeSeries(metric DDMetric) *prompb.TimeSeries {
+	seen := make(map[string]bool, len(metric.Tags)+1)
+	labels := make([]*prompb.Label, 0, len(metric.Tags)+1)
+
+	addLabel := func(name, value string) {
+		name = sanitizeMetricName(name)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		labels = append(labels, &prompb.Label{Name: name, Value: value})
+	}
+
+	addLabel("__name__", sanitizeMetricName(metric.Name))
+	for _, tag := range metric.Tags {
+		parts := strings.SplitN(tag, ":", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		addLabel(parts[0], value)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	samples := make([]prompb.Sample, 0, len(metric.Value))
+	for _, point := range metric.Value {
+		samples = append(samples, prompb.Sample{
+			Value:     point[1],
+			Timestamp: int64(point[0]) * 1000,
+		})
+	}
+
+	return &prompb.TimeSeries{
+		Labels:  labels,
+		Samples: samples,
+	}
+}
+
+// sanitizeMetricName replaces characters Prometheus doesn't allow in metric
+// and label names (anything but [a-zA-Z0-9_]) with underscores.
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
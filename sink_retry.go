@@ -0,0 +1,111 @@
+package veneur
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/softwaregravy/veneur/pkg/wal"
+)
+
+// RetryingSink wraps another MetricSink with a WAL-backed retry queue.
+// Flush appends each chunk to the WAL *before* attempting delivery, so a
+// veneur that crashes mid-POST still has the chunk on disk for Replay to
+// pick back up on restart. The segment is deleted on success; on failure
+// it's handed to a wal.RetryManager, which redelivers it with backoff
+// instead of dropping it on the floor.
+type RetryingSink struct {
+	inner  MetricSink
+	wal    *wal.WAL
+	retry  *wal.RetryManager
+	logger *logrus.Logger
+}
+
+// NewRetryingSink wraps inner with a WAL rooted at walDir, bounded to
+// maxDiskBytes of pending entries.
+func NewRetryingSink(inner MetricSink, walDir string, maxDiskBytes int64, stats *statsd.Client, logger *logrus.Logger) (*RetryingSink, error) {
+	w, err := wal.New(walDir, maxDiskBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RetryingSink{inner: inner, wal: w, logger: logger}
+	rs.retry = wal.NewRetryManager(w, rs.redeliver, stats)
+	if err := rs.retry.LoadFromDisk(); err != nil {
+		return nil, fmt.Errorf("replaying WAL for sink %s: %v", inner.Name(), err)
+	}
+	go rs.retry.Run()
+	return rs, nil
+}
+
+// Name defers to the wrapped sink's name.
+func (rs *RetryingSink) Name() string {
+	return rs.inner.Name()
+}
+
+// Flush appends metricSlice to the WAL, then attempts inner.Flush. On
+// success the segment is deleted; on failure it's left on disk and handed
+// to the RetryManager for redelivery. Either way Flush returns nil, since
+// from the caller's perspective the chunk has been durably handled.
+func (rs *RetryingSink) Flush(metricSlice []DDMetric) error {
+	body, encErr := encodeEntryBody(metricSlice)
+	if encErr != nil {
+		// can't even serialize it for the WAL; fall back to a bare
+		// attempt so we don't drop it outright
+		return rs.inner.Flush(metricSlice)
+	}
+
+	entry := wal.Entry{Sink: rs.inner.Name(), Body: body, Created: time.Now()}
+	id, err := rs.wal.Append(entry)
+	if err != nil {
+		rs.logger.WithError(err).WithField("sink", rs.inner.Name()).Error("Error appending to WAL; flushing without durability")
+		return rs.inner.Flush(metricSlice)
+	}
+
+	if err := rs.inner.Flush(metricSlice); err != nil {
+		rs.retry.Track(id, entry)
+		return nil
+	}
+	if err := rs.wal.Delete(id); err != nil {
+		rs.logger.WithError(err).WithField("sink", rs.inner.Name()).Error("Error deleting acknowledged WAL segment")
+	}
+	return nil
+}
+
+// redeliver is the wal.Sender used to retry a previously-failed chunk.
+func (rs *RetryingSink) redeliver(entry wal.Entry) error {
+	metrics, err := decodeEntryBody(entry.Body)
+	if err != nil {
+		return err
+	}
+	return rs.inner.Flush(metrics)
+}
+
+func encodeEntryBody(metrics []DDMetric) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(metrics); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntryBody(body []byte) ([]DDMetric, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var metrics []DDMetric
+	if err := json.NewDecoder(gz).Decode(&metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
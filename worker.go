@@ -2,55 +2,91 @@ package veneur
 
 import (
 	"fmt"
-	"sync"
+	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/Sirupsen/logrus"
 )
 
+// workerShardCount splits each metric type's map into this many shards,
+// keyed by a metric's digest. It doesn't add concurrent writers (a
+// Worker's own goroutine is still the only one ever calling
+// ProcessMetric), but it keeps any single map small, which keeps
+// individual map accesses and the eventual Flush iteration cheap even
+// for workers carrying a very high-cardinality metric name/tag set.
+const workerShardCount = 8
+
+// workerState holds everything a Worker accumulates between flushes.
+// Worker.Flush atomically swaps out the whole struct for a fresh one
+// rather than locking around each map.
+type workerState struct {
+	counters   [workerShardCount]map[uint32]*Counter
+	gauges     [workerShardCount]map[uint32]*Gauge
+	histograms [workerShardCount]map[uint32]*Histo
+	sets       [workerShardCount]map[uint32]*Set
+	timers     [workerShardCount]map[uint32]*Histo
+}
+
+func newWorkerState() *workerState {
+	st := &workerState{}
+	for i := 0; i < workerShardCount; i++ {
+		st.counters[i] = make(map[uint32]*Counter)
+		st.gauges[i] = make(map[uint32]*Gauge)
+		st.histograms[i] = make(map[uint32]*Histo)
+		st.sets[i] = make(map[uint32]*Set)
+		st.timers[i] = make(map[uint32]*Histo)
+	}
+	return st
+}
+
 // Worker is the doodad that does work.
 type Worker struct {
-	id         int
-	WorkChan   chan Metric
-	QuitChan   chan struct{}
-	metrics    int64
-	counters   map[uint32]*Counter
-	gauges     map[uint32]*Gauge
-	histograms map[uint32]*Histo
-	sets       map[uint32]*Set
-	timers     map[uint32]*Histo
-	mutex      *sync.Mutex
-	stats      *statsd.Client
-	logger     *logrus.Logger
+	id       int
+	WorkChan chan Metric
+	QuitChan chan struct{}
+	metrics  int64 // atomic
+
+	// state is a *workerState. ProcessMetric loads it without a lock and
+	// mutates its maps directly; that's only safe because exactly one
+	// goroutine (Work) ever calls ProcessMetric for a given Worker. Flush
+	// swaps in a fresh state and waits out any writer that grabbed the
+	// old one just before the swap.
+	state    atomic.Value
+	inflight int32 // atomic: ProcessMetric calls currently mutating state
+
+	stats  *statsd.Client
+	logger *logrus.Logger
 
 	histogramPercentiles []float64
 	histogramCounter     bool
+	histogramLocal       bool
 	bloomSetSize         uint
 	bloomSetAccuracy     float64
 }
 
-// NewWorker creates, and returns a new Worker object.
-func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger, percentiles []float64, histogramCounter bool, setSize uint, setAccuracy float64) *Worker {
-	return &Worker{
-		id:         id,
-		WorkChan:   make(chan Metric),
-		QuitChan:   make(chan struct{}),
-		metrics:    0,
-		counters:   make(map[uint32]*Counter),
-		gauges:     make(map[uint32]*Gauge),
-		histograms: make(map[uint32]*Histo),
-		sets:       make(map[uint32]*Set),
-		timers:     make(map[uint32]*Histo),
-		mutex:      &sync.Mutex{},
-		stats:      stats,
-		logger:     logger,
+// NewWorker creates, and returns a new Worker object. histogramLocal
+// controls whether histograms/timers report their own local percentiles
+// in addition to forwarding a sketch; pass false when this veneur also
+// forwards to a global instance, so the two don't report conflicting
+// percentiles under the same metric name.
+func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger, percentiles []float64, histogramCounter bool, histogramLocal bool, setSize uint, setAccuracy float64) *Worker {
+	w := &Worker{
+		id:       id,
+		WorkChan: make(chan Metric),
+		QuitChan: make(chan struct{}),
+		stats:    stats,
+		logger:   logger,
 
 		histogramPercentiles: percentiles,
 		histogramCounter:     histogramCounter,
+		histogramLocal:       histogramLocal,
 		bloomSetSize:         setSize,
 		bloomSetAccuracy:     setAccuracy,
 	}
+	w.state.Store(newWorkerState())
+	return w
 }
 
 func (w *Worker) Work() {
@@ -66,49 +102,71 @@ func (w *Worker) Work() {
 	}
 }
 
-// ProcessMetric takes a Metric and samples it
+// ProcessMetric takes a Metric and samples it.
 //
-// This is standalone to facilitate testing
+// ProcessMetric is NOT safe to call concurrently: the per-type shards in
+// workerState are plain maps with no synchronization of their own, and
+// the inflight/state dance in Flush only quiesces a single writer. The
+// only caller must be this Worker's own Work goroutine, which reads
+// WorkChan sequentially; anything that hands a Worker's metrics to more
+// than one goroutine (including calling ProcessMetric directly from a
+// test without Work's single-goroutine guarantee) risks a concurrent map
+// write panic. This is standalone (rather than inlined into Work) to
+// facilitate testing, not to suggest it's safe to call from elsewhere.
 func (w *Worker) ProcessMetric(m *Metric) {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
-	w.metrics++
+	atomic.AddInt32(&w.inflight, 1)
+	defer atomic.AddInt32(&w.inflight, -1)
+
+	st := w.state.Load().(*workerState)
+	shard := m.Digest % workerShardCount
+	atomic.AddInt64(&w.metrics, 1)
+
 	switch m.Type {
 	case "counter":
-		_, present := w.counters[m.Digest]
+		counters := st.counters[shard]
+		c, present := counters[m.Digest]
 		if !present {
 			w.logger.WithField("name", m.Name).Debug("New counter")
-			w.counters[m.Digest] = NewCounter(m.Name, m.Tags)
+			c = NewCounter(m.Name, m.Tags)
+			counters[m.Digest] = c
 		}
-		w.counters[m.Digest].Sample(m.Value.(float64), m.SampleRate)
+		c.Sample(m.Value.(float64), m.SampleRate)
 	case "gauge":
-		_, present := w.gauges[m.Digest]
+		gauges := st.gauges[shard]
+		g, present := gauges[m.Digest]
 		if !present {
 			w.logger.WithField("name", m.Name).Debug("New gauge")
-			w.gauges[m.Digest] = NewGauge(m.Name, m.Tags)
+			g = NewGauge(m.Name, m.Tags)
+			gauges[m.Digest] = g
 		}
-		w.gauges[m.Digest].Sample(m.Value.(float64), m.SampleRate)
+		g.Sample(m.Value.(float64), m.SampleRate)
 	case "histogram":
-		_, present := w.histograms[m.Digest]
+		histograms := st.histograms[shard]
+		h, present := histograms[m.Digest]
 		if !present {
 			w.logger.WithField("name", m.Name).Debug("New histogram")
-			w.histograms[m.Digest] = NewHist(m.Name, m.Tags, w.histogramPercentiles, w.histogramCounter)
+			h = NewHist(m.Name, m.Tags, w.histogramPercentiles, w.histogramCounter, w.histogramLocal)
+			histograms[m.Digest] = h
 		}
-		w.histograms[m.Digest].Sample(m.Value.(float64), m.SampleRate)
+		h.Sample(m.Value.(float64), m.SampleRate)
 	case "set":
-		_, present := w.sets[m.Digest]
+		sets := st.sets[shard]
+		s, present := sets[m.Digest]
 		if !present {
 			w.logger.WithField("name", m.Name).Debug("New set")
-			w.sets[m.Digest] = NewSet(m.Name, m.Tags, w.bloomSetSize, w.bloomSetAccuracy)
+			s = NewSet(m.Name, m.Tags, w.bloomSetSize, w.bloomSetAccuracy)
+			sets[m.Digest] = s
 		}
-		w.sets[m.Digest].Sample(m.Value.(string), m.SampleRate)
+		s.Sample(m.Value.(string), m.SampleRate)
 	case "timer":
-		_, present := w.timers[m.Digest]
+		timers := st.timers[shard]
+		t, present := timers[m.Digest]
 		if !present {
 			w.logger.WithField("name", m.Name).Debug("New timer")
-			w.timers[m.Digest] = NewHist(m.Name, m.Tags, w.histogramPercentiles, w.histogramCounter)
+			t = NewHist(m.Name, m.Tags, w.histogramPercentiles, w.histogramCounter, w.histogramLocal)
+			timers[m.Digest] = t
 		}
-		w.timers[m.Digest].Sample(m.Value.(float64), m.SampleRate)
+		t.Sample(m.Value.(float64), m.SampleRate)
 	default:
 		w.logger.WithField("type", m.Type).Error("Unknown metric type")
 	}
@@ -116,30 +174,34 @@ func (w *Worker) ProcessMetric(m *Metric) {
 
 // Flush generates DDMetrics to emit.
 func (w *Worker) Flush(interval time.Duration) []DDMetric {
-	// We preallocate a reasonably sized slice such that hopefully we won't need to reallocate.
+	start := time.Now()
+
+	// Swap in a fresh state for new samples to land in, then wait out
+	// whichever ProcessMetric call (if any) grabbed the old state just
+	// before the swap. Metrics are processed off a single channel by
+	// this worker's own goroutine, so there's never more than one
+	// writer to quiesce.
+	old := w.state.Load().(*workerState)
+	w.state.Store(newWorkerState())
+	for atomic.LoadInt32(&w.inflight) > 0 {
+		runtime.Gosched()
+	}
+
+	sampled := atomic.SwapInt64(&w.metrics, 0)
+	w.stats.Count("worker.metrics_processed_total", sampled, []string{fmt.Sprintf("worker:%d", w.id)}, 1.0)
+
+	// Number of each metric, with 4 + percentiles for histograms (count, max, min, sketch)
+	counterCount, gaugeCount, histoCount, setCount, timerCount := 0, 0, 0, 0, 0
+	for i := 0; i < workerShardCount; i++ {
+		counterCount += len(old.counters[i])
+		gaugeCount += len(old.gauges[i])
+		histoCount += len(old.histograms[i])
+		setCount += len(old.sets[i])
+		timerCount += len(old.timers[i])
+	}
 	postMetrics := make([]DDMetric, 0,
-		// Number of each metric, with 3 + percentiles for histograms (count, max, min)
-		len(w.counters)+len(w.gauges)+len(w.histograms)*(3+len(w.histogramPercentiles)),
+		counterCount+gaugeCount+histoCount*(4+len(w.histogramPercentiles)),
 	)
-	start := time.Now()
-	// This is a critical spot. The worker can't process metrics while this
-	// mutex is held! So we try and minimize it by copying the maps of values
-	// and assigning new ones.
-	w.mutex.Lock()
-	counters := w.counters
-	gauges := w.gauges
-	histograms := w.histograms
-	sets := w.sets
-	timers := w.timers
-	w.stats.Count("worker.metrics_processed_total", w.metrics, []string{fmt.Sprintf("worker:%d", w.id)}, 1.0)
-
-	w.counters = make(map[uint32]*Counter)
-	w.gauges = make(map[uint32]*Gauge)
-	w.histograms = make(map[uint32]*Histo)
-	w.sets = make(map[uint32]*Set)
-	w.timers = make(map[uint32]*Histo)
-	w.metrics = 0
-	w.mutex.Unlock()
 
 	// Track how much time each worker takes to flush.
 	w.stats.TimeInMilliseconds(
@@ -149,25 +211,35 @@ func (w *Worker) Flush(interval time.Duration) []DDMetric {
 		1.0,
 	)
 
-	w.stats.Count("worker.metrics_flushed_total", int64(len(counters)), []string{"metric_type:counter"}, 1.0)
-	for _, v := range counters {
-		postMetrics = append(postMetrics, v.Flush(interval)...)
+	w.stats.Count("worker.metrics_flushed_total", int64(counterCount), []string{"metric_type:counter"}, 1.0)
+	for _, shard := range old.counters {
+		for _, v := range shard {
+			postMetrics = append(postMetrics, v.Flush(interval)...)
+		}
 	}
-	w.stats.Count("worker.metrics_flushed_total", int64(len(gauges)), []string{"metric_type:gauge"}, 1.0)
-	for _, v := range gauges {
-		postMetrics = append(postMetrics, v.Flush()...)
+	w.stats.Count("worker.metrics_flushed_total", int64(gaugeCount), []string{"metric_type:gauge"}, 1.0)
+	for _, shard := range old.gauges {
+		for _, v := range shard {
+			postMetrics = append(postMetrics, v.Flush()...)
+		}
 	}
-	w.stats.Count("worker.metrics_flushed_total", int64(len(histograms)), []string{"metric_type:histogram"}, 1.0)
-	for _, v := range histograms {
-		postMetrics = append(postMetrics, v.Flush(interval)...)
+	w.stats.Count("worker.metrics_flushed_total", int64(histoCount), []string{"metric_type:histogram"}, 1.0)
+	for _, shard := range old.histograms {
+		for _, v := range shard {
+			postMetrics = append(postMetrics, v.Flush(interval)...)
+		}
 	}
-	w.stats.Count("worker.metrics_flushed_total", int64(len(sets)), []string{"metric_type:set"}, 1.0)
-	for _, v := range sets {
-		postMetrics = append(postMetrics, v.Flush()...)
+	w.stats.Count("worker.metrics_flushed_total", int64(setCount), []string{"metric_type:set"}, 1.0)
+	for _, shard := range old.sets {
+		for _, v := range shard {
+			postMetrics = append(postMetrics, v.Flush()...)
+		}
 	}
-	w.stats.Count("worker.metrics_flushed_total", int64(len(timers)), []string{"metric_type:timer"}, 1.0)
-	for _, v := range timers {
-		postMetrics = append(postMetrics, v.Flush(interval)...)
+	w.stats.Count("worker.metrics_flushed_total", int64(timerCount), []string{"metric_type:timer"}, 1.0)
+	for _, shard := range old.timers {
+		for _, v := range shard {
+			postMetrics = append(postMetrics, v.Flush(interval)...)
+		}
 	}
 
 	return postMetrics
@@ -178,4 +250,4 @@ func (w *Worker) Flush(interval time.Duration) []DDMetric {
 // Note that the worker will only stop *after* it has finished its work.
 func (w *Worker) Stop() {
 	close(w.QuitChan)
-}
\ No newline at end of file
+}